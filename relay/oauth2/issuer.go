@@ -0,0 +1,167 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// maxTokenResponseBytes bounds how much of the UAA's response body is read,
+// so a misbehaving or malicious UAA can't stall or OOM the caller.
+const maxTokenResponseBytes = 1 << 20 // 1 MiB
+
+// tokenRequestTimeout bounds how long a single UAA token request may take,
+// independent of any deadline on ctx, so a hung UAA can't stall a channel
+// indefinitely.
+const tokenRequestTimeout = 15 * time.Second
+
+var httpClient = &http.Client{Timeout: tokenRequestTimeout}
+
+var tracer = otel.Tracer("relay/oauth2")
+
+// TokenIssuer knows how to obtain a fresh access token from a UAA using a
+// particular OAuth2 grant. Concrete implementations fill in the grant-specific
+// form parameters; doTokenRequest handles the HTTP mechanics common to all of them.
+type TokenIssuer interface {
+	Issue(ctx context.Context, uaaUrl string) (*AccessTokenResponse, error)
+	// Credentials returns the client ID/secret this issuer authenticates with,
+	// so AccessTokenManager can build a RefreshTokenIssuer for renewal without
+	// the caller having to supply them again.
+	Credentials() (clientID, clientSecret string)
+}
+
+// ClientCredentialsIssuer issues tokens via the client_credentials grant.
+type ClientCredentialsIssuer struct {
+	ClientID     string
+	ClientSecret string
+}
+
+// Issue implements TokenIssuer.
+func (i *ClientCredentialsIssuer) Issue(ctx context.Context, uaaUrl string) (*AccessTokenResponse, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	return doTokenRequest(ctx, uaaUrl, form, i.ClientID, i.ClientSecret)
+}
+
+// Credentials implements TokenIssuer.
+func (i *ClientCredentialsIssuer) Credentials() (string, string) {
+	return i.ClientID, i.ClientSecret
+}
+
+// RefreshTokenIssuer renews a token via the refresh_token grant.
+type RefreshTokenIssuer struct {
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+}
+
+// Issue implements TokenIssuer.
+func (i *RefreshTokenIssuer) Issue(ctx context.Context, uaaUrl string) (*AccessTokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {i.RefreshToken},
+	}
+	return doTokenRequest(ctx, uaaUrl, form, i.ClientID, i.ClientSecret)
+}
+
+// Credentials implements TokenIssuer.
+func (i *RefreshTokenIssuer) Credentials() (string, string) {
+	return i.ClientID, i.ClientSecret
+}
+
+// PasswordIssuer issues tokens via the resource owner password grant, for
+// identity providers that require a user-context token rather than a
+// service-to-service one.
+type PasswordIssuer struct {
+	ClientID     string
+	ClientSecret string
+	Username     string
+	Password     string
+}
+
+// Issue implements TokenIssuer.
+func (i *PasswordIssuer) Issue(ctx context.Context, uaaUrl string) (*AccessTokenResponse, error) {
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {i.Username},
+		"password":   {i.Password},
+	}
+	return doTokenRequest(ctx, uaaUrl, form, i.ClientID, i.ClientSecret)
+}
+
+// Credentials implements TokenIssuer.
+func (i *PasswordIssuer) Credentials() (string, string) {
+	return i.ClientID, i.ClientSecret
+}
+
+// doTokenRequest POSTs form to uaaUrl's /oauth/token endpoint using HTTP basic
+// auth for the client credentials, and decodes either the token or the UAA's
+// error body. The request is wrapped in a span so slow or failing UAA calls
+// are visible in traces, and is bounded by both ctx and tokenRequestTimeout.
+func doTokenRequest(ctx context.Context, uaaUrl string, form url.Values, clientID, clientSecret string) (*AccessTokenResponse, error) {
+	ctx, span := tracer.Start(ctx, "oauth2.IssueToken")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("oauth2.grant_type", form.Get("grant_type")),
+		attribute.String("oauth2.uaa_url", uaaUrl),
+	)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", uaaUrl+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	encodedCredential := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", clientID, clientSecret)))
+	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", encodedCredential))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseBytes))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var tokenErr TokenErrorResponse
+		_ = json.Unmarshal(body, &tokenErr)
+		err := &TokenError{
+			StatusCode:       resp.StatusCode,
+			Err:              tokenErr.Error,
+			ErrorDescription: tokenErr.ErrorDescription,
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	var tokenResp AccessTokenResponse
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return &tokenResp, nil
+}
@@ -1,100 +1,404 @@
 package oauth2
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"strings"
+	"math/rand"
 	"sync"
 	"time"
 )
 
+// defaultTokenTTL is used when the UAA response omits expires_in.
+const defaultTokenTTL = time.Hour
+
+// defaultExpiryMargin is subtracted from the server-supplied expires_in so
+// that a token is treated as stale slightly before the UAA actually rejects
+// it, unless a caller overrides it with WithExpiryMargin.
+const defaultExpiryMargin = 60 * time.Second
+
+// refreshAheadRatio is the fraction of a token's lifetime that must elapse
+// before the manager proactively renews it in the background, instead of
+// waiting for a caller to observe an expired token.
+const refreshAheadRatio = 0.8
+
+// refreshJitter bounds the random delay added to each proactive refresh so
+// that many tenants sharing a UAA don't all renew at the same instant.
+const refreshJitter = 5 * time.Second
+
 // AccessToken represents the BTP access token.
 type AccessToken struct {
-	Value     string
-	ExpiresAt time.Time
+	Value        string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+// tokenCall tracks an in-flight token request for a given cache key so that
+// concurrent callers coalesce into a single HTTP round trip.
+type tokenCall struct {
+	done  chan struct{}
+	token *AccessToken
+	err   error
+}
+
+// refresher owns the background goroutine that keeps a single cache key's
+// token renewed ahead of its expiry.
+type refresher struct {
+	stop chan struct{}
+	done chan struct{}
 }
 
 // AccessTokenManager manages the BTP access tokens and their caching.
 type AccessTokenManager struct {
 	mutex      sync.Mutex
 	tokenCache map[string]*AccessToken
+	inflight   map[string]*tokenCall
+	refreshers map[string]*refresher
+
+	// store is the source of truth for cached tokens; tokenCache is an L1 cache in front of it.
+	store TokenStore
+
+	// expiryMargin is subtracted from a token's server-supplied expires_in; see WithExpiryMargin.
+	expiryMargin time.Duration
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// ManagerOption configures an AccessTokenManager at construction time.
+type ManagerOption func(*AccessTokenManager)
+
+// WithTokenStore sets the TokenStore used as the source of truth for cached
+// tokens. The default is an in-memory store.
+func WithTokenStore(store TokenStore) ManagerOption {
+	return func(tm *AccessTokenManager) {
+		tm.store = store
+	}
+}
+
+// WithExpiryMargin overrides how far ahead of a token's server-supplied
+// expires_in it is treated as stale. The default is defaultExpiryMargin.
+func WithExpiryMargin(margin time.Duration) ManagerOption {
+	return func(tm *AccessTokenManager) {
+		tm.expiryMargin = margin
+	}
 }
 
 // AccessTokenResponse represents the structure of the token response JSON.
 type AccessTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int    `json:"expires_in"`
-	Scope       string `json:"scope"`
-	Jti         string `json:"jti"`
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+	Jti          string `json:"jti"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// TokenErrorResponse represents the error body a UAA returns alongside a
+// non-2xx status, e.g. {"error":"invalid_client","error_description":"..."}.
+type TokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
 }
 
-// NewAccessTokenManager creates a new AccessTokenManager instance.
-func NewAccessTokenManager() *AccessTokenManager {
-	return &AccessTokenManager{
-		tokenCache: make(map[string]*AccessToken),
+// TokenError is returned when the UAA responds with a non-2xx status. It
+// carries the HTTP status code plus whatever error/error_description the
+// server supplied, so callers can distinguish e.g. invalid_client from a
+// transient 5xx.
+type TokenError struct {
+	StatusCode       int
+	Err              string
+	ErrorDescription string
+}
+
+func (e *TokenError) Error() string {
+	if e.Err == "" {
+		return fmt.Sprintf("oauth2: token request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("oauth2: token request failed with status %d: %s: %s", e.StatusCode, e.Err, e.ErrorDescription)
+}
+
+// NewAccessTokenManager creates a new AccessTokenManager, backed by an
+// in-memory TokenStore and the default expiry margin unless overridden by opts.
+func NewAccessTokenManager(opts ...ManagerOption) *AccessTokenManager {
+	tm := &AccessTokenManager{
+		tokenCache:   make(map[string]*AccessToken),
+		inflight:     make(map[string]*tokenCall),
+		refreshers:   make(map[string]*refresher),
+		store:        NewMemoryTokenStore(),
+		expiryMargin: defaultExpiryMargin,
+		closed:       make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(tm)
+	}
+	return tm
+}
+
+// NewAccessTokenManagerWithStore creates a new AccessTokenManager that uses
+// store as the source of truth for tokens, e.g. a RedisTokenStore or
+// SQLTokenStore shared across replicas.
+func NewAccessTokenManagerWithStore(store TokenStore) *AccessTokenManager {
+	return NewAccessTokenManager(WithTokenStore(store))
+}
+
+// GetAccessToken retrieves the BTP token for clientID via the client_credentials
+// grant. It is a convenience wrapper around GetAccessTokenWithIssuer for the
+// common case; callers that need a different grant (refresh_token, password, ...)
+// should use GetAccessTokenWithIssuer directly.
+func (tm *AccessTokenManager) GetAccessToken(ctx context.Context, clientID, clientSecret, uaaUrl string) (string, error) {
+	issuer := &ClientCredentialsIssuer{ClientID: clientID, ClientSecret: clientSecret}
+	return tm.GetAccessTokenWithIssuer(ctx, clientID, issuer, uaaUrl)
 }
 
-// GetAccessToken retrieves the BTP token. If a valid token is available in the cache, it returns it.
-// Otherwise, it generates a new accessToken using the client ID and secret.
-func (tm *AccessTokenManager) GetAccessToken(clientID, clientSecret, uaaUrl string) (string, error) {
+// GetAccessTokenWithIssuer retrieves a token cached under cacheKey, using issuer
+// to mint one if the cache and store are both empty or stale. This lets a
+// caller select any TokenIssuer grant (e.g. PasswordIssuer, for identity
+// providers where a user-context token is required) while still getting the
+// manager's caching, singleflight coalescing and background refresh. cacheKey
+// is typically the clientID, but callers juggling multiple issuers for the
+// same clientID (e.g. client_credentials and password grants side by side)
+// should pick a key that distinguishes them.
+func (tm *AccessTokenManager) GetAccessTokenWithIssuer(ctx context.Context, cacheKey string, issuer TokenIssuer, uaaUrl string) (string, error) {
 	tm.mutex.Lock()
-	defer tm.mutex.Unlock()
 
-	// Check if a valid token exists in the cache
-	if token, ok := tm.tokenCache[clientID]; ok && time.Now().Before(token.ExpiresAt) {
+	if token, ok := tm.tokenCache[cacheKey]; ok && time.Now().Before(token.ExpiresAt) {
+		tm.ensureRefresherLocked(cacheKey, issuer, uaaUrl)
+		tm.mutex.Unlock()
+		metricCacheResult.WithLabelValues("hit").Inc()
 		return token.Value, nil
 	}
+	metricCacheResult.WithLabelValues("miss").Inc()
+
+	if call, ok := tm.inflight[cacheKey]; ok {
+		tm.mutex.Unlock()
+		<-call.done
+		if call.err != nil {
+			return "", call.err
+		}
+		return call.token.Value, nil
+	}
+
+	call := &tokenCall{done: make(chan struct{})}
+	tm.inflight[cacheKey] = call
+	tm.mutex.Unlock()
+
+	newToken, err := tm.loadOrGenerateToken(ctx, cacheKey, issuer, uaaUrl)
+
+	tm.mutex.Lock()
+	delete(tm.inflight, cacheKey)
+	if err == nil {
+		tm.tokenCache[cacheKey] = newToken
+		tm.ensureRefresherLocked(cacheKey, issuer, uaaUrl)
+	}
+	tm.mutex.Unlock()
+
+	call.token = newToken
+	call.err = err
+	close(call.done)
 
-	// Generate a new accessToken
-	newToken, err := generateAccessToken(clientID, clientSecret, uaaUrl)
 	if err != nil {
 		return "", err
 	}
-	tm.tokenCache[clientID] = newToken
-
 	return newToken.Value, nil
 }
 
-func generateAccessToken(clientID, clientSecret, uaaUrl string) (*AccessToken, error) {
-	url := uaaUrl + "/oauth/token?grant_type=client_credentials"
-	payload := ""
+// ensureRefresherLocked starts a background refresh goroutine for cacheKey if
+// one isn't already running. The caller must hold tm.mutex.
+func (tm *AccessTokenManager) ensureRefresherLocked(cacheKey string, issuer TokenIssuer, uaaUrl string) {
+	if _, ok := tm.refreshers[cacheKey]; ok {
+		return
+	}
 
-	req, err := http.NewRequest("POST", url, strings.NewReader(payload))
-	if err != nil {
-		return nil, err
+	r := &refresher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
 	}
+	tm.refreshers[cacheKey] = r
 
-	encodedCredential := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", clientID, clientSecret)))
-	authHeader := fmt.Sprintf("Basic %s", encodedCredential)
-	req.Header.Set("Authorization", authHeader)
+	go tm.refreshLoop(cacheKey, issuer, uaaUrl, r)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+// refreshLoop periodically renews cacheKey's token shortly before it expires,
+// until Stop/Close is called or the manager itself is closed. It runs detached
+// from any caller's request context, since it must keep renewing long after
+// the GetAccessToken(WithIssuer) call that started it has returned.
+func (tm *AccessTokenManager) refreshLoop(cacheKey string, issuer TokenIssuer, uaaUrl string, r *refresher) {
+	defer close(r.done)
+
+	for {
+		tm.mutex.Lock()
+		token, ok := tm.tokenCache[cacheKey]
+		tm.mutex.Unlock()
+		if !ok {
+			return
+		}
+
+		delay := nextRefreshDelay(token.ExpiresAt)
+
+		select {
+		case <-time.After(delay):
+		case <-r.stop:
+			return
+		case <-tm.closed:
+			return
+		}
+
+		// Another replica sharing tm.store may already have refreshed this
+		// token since we last read it; adopt it instead of making our own UAA
+		// call, so N replicas don't each burn their own issuance quota.
+		if tm.store != nil {
+			if stored, err := tm.store.Get(context.Background(), cacheKey); err == nil && stored.ExpiresAt.After(token.ExpiresAt) {
+				tm.mutex.Lock()
+				tm.tokenCache[cacheKey] = stored
+				tm.mutex.Unlock()
+				continue
+			}
+		}
+
+		newToken, err := renewAccessToken(context.Background(), issuer, uaaUrl, token, tm.expiryMargin)
+		if err != nil {
+			logTokenEvent("refresh_failed", cacheKey, err)
+			// Back off briefly and retry rather than spinning on a failing UAA.
+			select {
+			case <-time.After(refreshJitter):
+			case <-r.stop:
+				return
+			case <-tm.closed:
+				return
+			}
+			continue
+		}
+
+		tm.mutex.Lock()
+		tm.tokenCache[cacheKey] = newToken
+		tm.mutex.Unlock()
+		tm.putToStore(context.Background(), cacheKey, newToken)
+	}
+}
+
+// loadOrGenerateToken returns cacheKey's token from the store if one is
+// cached there and still valid. If the store holds an expired entry, its
+// refresh_token (if any) is tried before falling back to issuer, so a
+// cache-miss doesn't needlessly re-authenticate with fresh credentials when a
+// cheaper renewal is available. The result is persisted back to the store.
+func (tm *AccessTokenManager) loadOrGenerateToken(ctx context.Context, cacheKey string, issuer TokenIssuer, uaaUrl string) (*AccessToken, error) {
+	var stored *AccessToken
+	if tm.store != nil {
+		if token, err := tm.store.Get(ctx, cacheKey); err == nil {
+			if time.Now().Before(token.ExpiresAt) {
+				return token, nil
+			}
+			stored = token
+		}
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	newToken, err := renewAccessToken(ctx, issuer, uaaUrl, stored, tm.expiryMargin)
 	if err != nil {
+		logTokenEvent("issuance_failed", cacheKey, err)
 		return nil, err
 	}
+	tm.putToStore(ctx, cacheKey, newToken)
+	return newToken, nil
+}
+
+// putToStore writes token to the configured TokenStore, if any, using the
+// token's remaining lifetime as the store TTL.
+func (tm *AccessTokenManager) putToStore(ctx context.Context, cacheKey string, token *AccessToken) {
+	if tm.store == nil {
+		return
+	}
+	ttl := time.Until(token.ExpiresAt)
+	if ttl < 0 {
+		ttl = 0
+	}
+	_ = tm.store.Put(ctx, cacheKey, token, ttl)
+}
+
+// nextRefreshDelay returns how long to wait before proactively refreshing a
+// token expiring at expiresAt, aiming for refreshAheadRatio of its remaining
+// lifetime and adding a small random jitter to avoid thundering herds.
+func nextRefreshDelay(expiresAt time.Time) time.Duration {
+	remaining := time.Until(expiresAt)
+	delay := time.Duration(float64(remaining) * refreshAheadRatio)
+	if delay < 0 {
+		delay = 0
+	}
+	jitter := time.Duration(rand.Int63n(int64(refreshJitter)))
+	return delay + jitter
+}
+
+// Stop terminates the background refresh goroutine for a single cacheKey, if any.
+func (tm *AccessTokenManager) Stop(cacheKey string) {
+	tm.mutex.Lock()
+	r, ok := tm.refreshers[cacheKey]
+	if ok {
+		delete(tm.refreshers, cacheKey)
+	}
+	tm.mutex.Unlock()
+
+	if ok {
+		close(r.stop)
+		<-r.done
+	}
+}
+
+// Close terminates all background refresh goroutines managed by tm. It is safe
+// to call multiple times.
+func (tm *AccessTokenManager) Close() {
+	tm.closeOnce.Do(func() {
+		close(tm.closed)
+	})
+
+	tm.mutex.Lock()
+	refreshers := make([]*refresher, 0, len(tm.refreshers))
+	for cacheKey, r := range tm.refreshers {
+		refreshers = append(refreshers, r)
+		delete(tm.refreshers, cacheKey)
+	}
+	tm.mutex.Unlock()
+
+	for _, r := range refreshers {
+		<-r.done
+	}
+}
+
+// renewAccessToken renews current's token, preferring the refresh_token grant
+// when current carries one and falling back to re-issuing via issuer's own
+// grant (client_credentials, password, ...) if the refresh is rejected (e.g.
+// the refresh token expired or was revoked) or current is nil.
+func renewAccessToken(ctx context.Context, issuer TokenIssuer, uaaUrl string, current *AccessToken, margin time.Duration) (*AccessToken, error) {
+	if current != nil && current.RefreshToken != "" {
+		clientID, clientSecret := issuer.Credentials()
+		refreshIssuer := &RefreshTokenIssuer{ClientID: clientID, ClientSecret: clientSecret, RefreshToken: current.RefreshToken}
+		if token, err := issueAccessToken(ctx, refreshIssuer, uaaUrl, margin); err == nil {
+			return token, nil
+		}
+	}
+	return issueAccessToken(ctx, issuer, uaaUrl, margin)
+}
 
-	var tokenResp AccessTokenResponse
-	err = json.Unmarshal(body, &tokenResp)
+// issueAccessToken runs issuer against uaaUrl and converts the raw token
+// response into an AccessToken, subtracting margin from its reported
+// lifetime. It records the issuance latency and outcome as metrics.
+func issueAccessToken(ctx context.Context, issuer TokenIssuer, uaaUrl string, margin time.Duration) (*AccessToken, error) {
+	start := time.Now()
+	tokenResp, err := issuer.Issue(ctx, uaaUrl)
+	observeIssuance(time.Since(start), err)
 	if err != nil {
 		return nil, err
 	}
 
-	accessToken := &AccessToken{
-		Value:     tokenResp.AccessToken,
-		ExpiresAt: time.Now().Add(time.Hour),
+	ttl := defaultTokenTTL
+	if tokenResp.ExpiresIn > 0 {
+		ttl = time.Duration(tokenResp.ExpiresIn) * time.Second
+		if ttl > margin {
+			ttl -= margin
+		}
 	}
 
-	return accessToken, nil
+	return &AccessToken{
+		Value:        tokenResp.AccessToken,
+		RefreshToken: tokenResp.RefreshToken,
+		ExpiresAt:    time.Now().Add(ttl),
+	}, nil
 }
@@ -0,0 +1,184 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTokenServer returns a fake UAA that always issues a fresh token with the
+// given expires_in, and a counter of how many requests it has received.
+func newTokenServer(t *testing.T, expiresIn int) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(AccessTokenResponse{
+			AccessToken: fmt.Sprintf("token-%d", n),
+			ExpiresIn:   expiresIn,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestGetAccessToken_SingleflightCoalescesConcurrentCalls(t *testing.T) {
+	srv, hits := newTokenServer(t, 3600)
+
+	tm := NewAccessTokenManager()
+	defer tm.Close()
+
+	const callers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			if _, err := tm.GetAccessToken(context.Background(), "client", "secret", srv.URL); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("unexpected error from GetAccessToken: %v", err)
+	}
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Fatalf("expected exactly 1 UAA request from %d concurrent callers, got %d", callers, got)
+	}
+}
+
+func TestClose_StopsBackgroundRefreshPromptly(t *testing.T) {
+	srv, _ := newTokenServer(t, 3600) // long expiry: refresh loop should be parked on its timer
+
+	tm := NewAccessTokenManager()
+	if _, err := tm.GetAccessToken(context.Background(), "client", "secret", srv.URL); err != nil {
+		t.Fatalf("GetAccessToken: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tm.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return promptly; the background refresh goroutine may be leaking")
+	}
+}
+
+func TestGetAccessToken_PrefersValidStoreEntryOverUAA(t *testing.T) {
+	srv, hits := newTokenServer(t, 3600)
+
+	store := NewMemoryTokenStore()
+	cached := &AccessToken{Value: "cached-token", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.Put(context.Background(), "client", cached, time.Hour); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	tm := NewAccessTokenManager(WithTokenStore(store))
+	defer tm.Close()
+
+	got, err := tm.GetAccessToken(context.Background(), "client", "secret", srv.URL)
+	if err != nil {
+		t.Fatalf("GetAccessToken: %v", err)
+	}
+	if got != cached.Value {
+		t.Fatalf("got token %q, want the store's cached %q", got, cached.Value)
+	}
+	if got := atomic.LoadInt32(hits); got != 0 {
+		t.Fatalf("expected no UAA request when the store already has a valid token, got %d", got)
+	}
+}
+
+func TestGetAccessTokenWithIssuer_PasswordGrant(t *testing.T) {
+	var gotGrant string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		gotGrant = r.FormValue("grant_type")
+		_ = json.NewEncoder(w).Encode(AccessTokenResponse{AccessToken: "pw-token", ExpiresIn: 3600})
+	}))
+	defer srv.Close()
+
+	tm := NewAccessTokenManager()
+	defer tm.Close()
+
+	issuer := &PasswordIssuer{ClientID: "client", ClientSecret: "secret", Username: "u", Password: "p"}
+	got, err := tm.GetAccessTokenWithIssuer(context.Background(), "client:password", issuer, srv.URL)
+	if err != nil {
+		t.Fatalf("GetAccessTokenWithIssuer: %v", err)
+	}
+	if got != "pw-token" {
+		t.Fatalf("got %q, want pw-token", got)
+	}
+	if gotGrant != "password" {
+		t.Fatalf("expected the password grant to reach the UAA, got %q", gotGrant)
+	}
+}
+
+func TestRenewAccessToken_PrefersRefreshToken(t *testing.T) {
+	var gotGrant string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		gotGrant = r.FormValue("grant_type")
+		_ = json.NewEncoder(w).Encode(AccessTokenResponse{AccessToken: "refreshed", ExpiresIn: 3600})
+	}))
+	defer srv.Close()
+
+	primary := &ClientCredentialsIssuer{ClientID: "client", ClientSecret: "secret"}
+	current := &AccessToken{Value: "old", RefreshToken: "refresh-tok", ExpiresAt: time.Now().Add(-time.Minute)}
+
+	token, err := renewAccessToken(context.Background(), primary, srv.URL, current, 0)
+	if err != nil {
+		t.Fatalf("renewAccessToken: %v", err)
+	}
+	if token.Value != "refreshed" {
+		t.Fatalf("got token %q, want refreshed", token.Value)
+	}
+	if gotGrant != "refresh_token" {
+		t.Fatalf("expected refresh_token to be tried before the primary grant, got %q", gotGrant)
+	}
+}
+
+func TestRenewAccessToken_FallsBackToPrimaryWhenRefreshFails(t *testing.T) {
+	var grants []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		grant := r.FormValue("grant_type")
+		grants = append(grants, grant)
+		if grant == "refresh_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(TokenErrorResponse{Error: "invalid_grant"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(AccessTokenResponse{AccessToken: "fresh", ExpiresIn: 3600})
+	}))
+	defer srv.Close()
+
+	primary := &ClientCredentialsIssuer{ClientID: "client", ClientSecret: "secret"}
+	current := &AccessToken{Value: "old", RefreshToken: "stale-refresh", ExpiresAt: time.Now().Add(-time.Minute)}
+
+	token, err := renewAccessToken(context.Background(), primary, srv.URL, current, 0)
+	if err != nil {
+		t.Fatalf("renewAccessToken: %v", err)
+	}
+	if token.Value != "fresh" {
+		t.Fatalf("got token %q, want fresh", token.Value)
+	}
+	if len(grants) != 2 || grants[0] != "refresh_token" || grants[1] != "client_credentials" {
+		t.Fatalf("unexpected grant sequence: %v", grants)
+	}
+}
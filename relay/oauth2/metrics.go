@@ -0,0 +1,73 @@
+package oauth2
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// metricCacheResult counts GetAccessToken calls by whether the cached
+	// token was still valid ("hit") or had to be renewed ("miss").
+	metricCacheResult = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oneapi",
+		Subsystem: "oauth2",
+		Name:      "token_cache_total",
+		Help:      "Count of AccessTokenManager.GetAccessToken calls by cache result.",
+	}, []string{"result"})
+
+	// metricIssuanceDuration observes how long a UAA token request took.
+	metricIssuanceDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "oneapi",
+		Subsystem: "oauth2",
+		Name:      "token_issuance_duration_seconds",
+		Help:      "Latency of UAA token requests made by AccessTokenManager.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// metricIssuanceResult counts UAA token requests by outcome, bucketing
+	// failures by the UAA's HTTP status code where available.
+	metricIssuanceResult = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oneapi",
+		Subsystem: "oauth2",
+		Name:      "token_issuance_total",
+		Help:      "Count of UAA token requests by outcome.",
+	}, []string{"outcome"})
+)
+
+// observeIssuance records the latency and outcome of a single UAA token request.
+func observeIssuance(d time.Duration, err error) {
+	metricIssuanceDuration.Observe(d.Seconds())
+	metricIssuanceResult.WithLabelValues(issuanceOutcome(err)).Inc()
+}
+
+// issuanceOutcome turns an issuance error into a low-cardinality metric label.
+func issuanceOutcome(err error) string {
+	if err == nil {
+		return "success"
+	}
+	tokenErr, ok := err.(*TokenError)
+	if !ok {
+		return "error"
+	}
+	switch {
+	case tokenErr.StatusCode >= 500:
+		return "uaa_5xx"
+	case tokenErr.StatusCode >= 400:
+		return "uaa_4xx"
+	default:
+		return "error"
+	}
+}
+
+// logTokenEvent emits a structured (key=value) log line for a token lifecycle
+// event, so operators can see why a BTP-backed channel is slow or failing
+// without having to correlate request IDs across services. cacheKey is
+// whatever AccessTokenManager cached the token under, which is not always a
+// clientID once callers use GetAccessTokenWithIssuer with a composite key
+// (e.g. "client:password").
+func logTokenEvent(event, cacheKey string, err error) {
+	log.Printf("msg=%q event=%q cache_key=%q err=%q", "oauth2 token event", event, cacheKey, err)
+}
@@ -0,0 +1,193 @@
+package oauth2
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTokenNotFound is returned by a TokenStore when no token is stored for a key.
+var ErrTokenNotFound = errors.New("oauth2: token not found")
+
+// TokenStore is the source of truth for cached tokens. AccessTokenManager
+// keeps its in-process tokenCache as a short-lived L1 in front of a TokenStore,
+// so that restarts and horizontally scaled replicas don't each have to hit the
+// UAA to obtain a token that's already valid elsewhere.
+type TokenStore interface {
+	Get(ctx context.Context, key string) (*AccessToken, error)
+	Put(ctx context.Context, key string, token *AccessToken, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// MemoryTokenStore is the default TokenStore: it keeps tokens only in process
+// memory, matching the manager's original behavior.
+type MemoryTokenStore struct {
+	mutex sync.Mutex
+	data  map[string]*AccessToken
+}
+
+// NewMemoryTokenStore creates an empty MemoryTokenStore.
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{data: make(map[string]*AccessToken)}
+}
+
+// Get implements TokenStore.
+func (s *MemoryTokenStore) Get(_ context.Context, key string) (*AccessToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token, ok := s.data[key]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return token, nil
+}
+
+// Put implements TokenStore. ttl is ignored since expiry is already tracked on
+// the token itself via ExpiresAt.
+func (s *MemoryTokenStore) Put(_ context.Context, key string, token *AccessToken, _ time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data[key] = token
+	return nil
+}
+
+// Delete implements TokenStore.
+func (s *MemoryTokenStore) Delete(_ context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.data, key)
+	return nil
+}
+
+// RedisClient is the minimal subset of a Redis client that RedisTokenStore
+// needs, so callers can pass in whatever client (go-redis, redigo wrapper,
+// ...) the rest of the application already uses. On a cache miss, Get must
+// return ("", nil) rather than an error: RedisTokenStore treats an empty
+// string as "no value for this key", not go-redis's redis.Nil. Callers
+// wrapping a client whose Get returns a miss as an error (e.g. go-redis)
+// must translate redis.Nil to ("", nil) in their adapter.
+type RedisClient interface {
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+	Del(ctx context.Context, key string) error
+}
+
+// RedisTokenStore stores tokens in Redis as JSON, keyed by prefix+key, so that
+// multiple one-api replicas behind the same Redis instance share tokens and
+// stay under the UAA's issuance quota.
+type RedisTokenStore struct {
+	client RedisClient
+	prefix string
+}
+
+// NewRedisTokenStore creates a RedisTokenStore using client, namespacing keys
+// under prefix (e.g. "oauth2:token:").
+func NewRedisTokenStore(client RedisClient, prefix string) *RedisTokenStore {
+	return &RedisTokenStore{client: client, prefix: prefix}
+}
+
+// Get implements TokenStore.
+func (s *RedisTokenStore) Get(ctx context.Context, key string) (*AccessToken, error) {
+	raw, err := s.client.Get(ctx, s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if raw == "" {
+		return nil, ErrTokenNotFound
+	}
+
+	var token AccessToken
+	if err := json.Unmarshal([]byte(raw), &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Put implements TokenStore.
+func (s *RedisTokenStore) Put(ctx context.Context, key string, token *AccessToken, ttl time.Duration) error {
+	raw, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.prefix+key, string(raw), ttl)
+}
+
+// Delete implements TokenStore.
+func (s *RedisTokenStore) Delete(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.prefix+key)
+}
+
+// SQLTokenStore persists tokens in a SQL table, for deployments that already
+// run one-api's SQL store but don't want to add a Redis dependency just for
+// token caching. The table is expected to have the columns
+// (token_key TEXT PRIMARY KEY, value TEXT, refresh_token TEXT, expires_at DATETIME).
+type SQLTokenStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLTokenStore creates a SQLTokenStore backed by db, reading and writing
+// rows in table.
+func NewSQLTokenStore(db *sql.DB, table string) *SQLTokenStore {
+	return &SQLTokenStore{db: db, table: table}
+}
+
+// Get implements TokenStore.
+func (s *SQLTokenStore) Get(ctx context.Context, key string) (*AccessToken, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT value, refresh_token, expires_at FROM "+s.table+" WHERE token_key = ?", key)
+
+	var token AccessToken
+	if err := row.Scan(&token.Value, &token.RefreshToken, &token.ExpiresAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Put implements TokenStore. It upserts via UPDATE-then-INSERT rather than
+// DELETE-then-INSERT: two replicas racing to Put the same key can otherwise
+// both see the row gone and both INSERT, and one loses to a primary-key
+// violation (or worse, a write is silently dropped). Here, if our UPDATE
+// affects no rows we INSERT; if that INSERT loses a race to a concurrent
+// writer, we retry the UPDATE, so the call always converges on one writer's
+// value without surfacing a spurious error.
+func (s *SQLTokenStore) Put(ctx context.Context, key string, token *AccessToken, _ time.Duration) error {
+	update := "UPDATE " + s.table + " SET value = ?, refresh_token = ?, expires_at = ? WHERE token_key = ?"
+
+	res, err := s.db.ExecContext(ctx, update, token.Value, token.RefreshToken, token.ExpiresAt, key)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+		return nil
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO "+s.table+" (token_key, value, refresh_token, expires_at) VALUES (?, ?, ?, ?)",
+		key, token.Value, token.RefreshToken, token.ExpiresAt)
+	if err == nil {
+		return nil
+	}
+
+	res, retryErr := s.db.ExecContext(ctx, update, token.Value, token.RefreshToken, token.ExpiresAt, key)
+	if retryErr == nil {
+		if rows, rerr := res.RowsAffected(); rerr == nil && rows > 0 {
+			return nil
+		}
+	}
+	return err
+}
+
+// Delete implements TokenStore.
+func (s *SQLTokenStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE token_key = ?", key)
+	return err
+}
@@ -0,0 +1,179 @@
+package oauth2
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// fakeRedisClient is a minimal in-memory RedisClient double, implementing the
+// same miss contract documented on RedisClient: Get returns ("", nil) for a
+// key that was never Set.
+type fakeRedisClient struct {
+	mutex sync.Mutex
+	data  map[string]string
+}
+
+func newFakeRedisClient() *fakeRedisClient {
+	return &fakeRedisClient{data: make(map[string]string)}
+}
+
+func (c *fakeRedisClient) Get(_ context.Context, key string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.data[key], nil
+}
+
+func (c *fakeRedisClient) Set(_ context.Context, key string, value string, _ time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.data[key] = value
+	return nil
+}
+
+func (c *fakeRedisClient) Del(_ context.Context, key string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.data, key)
+	return nil
+}
+
+func TestRedisTokenStore_GetTranslatesMissToErrTokenNotFound(t *testing.T) {
+	store := NewRedisTokenStore(newFakeRedisClient(), "oauth2:token:")
+
+	_, err := store.Get(context.Background(), "missing")
+	if !errors.Is(err, ErrTokenNotFound) {
+		t.Fatalf("got err %v, want ErrTokenNotFound", err)
+	}
+}
+
+func TestRedisTokenStore_PutGetRoundTrips(t *testing.T) {
+	store := NewRedisTokenStore(newFakeRedisClient(), "oauth2:token:")
+
+	token := &AccessToken{Value: "v", RefreshToken: "r", ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Second)}
+	if err := store.Put(context.Background(), "client", token, time.Hour); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	got, err := store.Get(context.Background(), "client")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Value != token.Value || got.RefreshToken != token.RefreshToken || !got.ExpiresAt.Equal(token.ExpiresAt) {
+		t.Fatalf("got %+v, want %+v", got, token)
+	}
+}
+
+// openSQLiteTokenTable opens a shared in-memory SQLite database and creates
+// the table SQLTokenStore expects. Multiple connections share the same
+// database (cache=shared) so the race test below can exercise real
+// concurrent writers rather than a single serialized connection.
+func openSQLiteTokenTable(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(4)
+
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+		t.Fatalf("set busy_timeout: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE tokens (
+		token_key TEXT PRIMARY KEY,
+		value TEXT,
+		refresh_token TEXT,
+		expires_at DATETIME
+	)`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	return db
+}
+
+func TestSQLTokenStore_PutInsertsThenUpdates(t *testing.T) {
+	db := openSQLiteTokenTable(t)
+	store := NewSQLTokenStore(db, "tokens")
+
+	first := &AccessToken{Value: "v1", RefreshToken: "r1", ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Second)}
+	if err := store.Put(context.Background(), "client", first, time.Hour); err != nil {
+		t.Fatalf("first Put (insert path): %v", err)
+	}
+	got, err := store.Get(context.Background(), "client")
+	if err != nil {
+		t.Fatalf("Get after insert: %v", err)
+	}
+	if got.Value != first.Value {
+		t.Fatalf("got value %q, want %q", got.Value, first.Value)
+	}
+
+	second := &AccessToken{Value: "v2", RefreshToken: "r2", ExpiresAt: time.Now().Add(2 * time.Hour).Truncate(time.Second)}
+	if err := store.Put(context.Background(), "client", second, time.Hour); err != nil {
+		t.Fatalf("second Put (update path): %v", err)
+	}
+	got, err = store.Get(context.Background(), "client")
+	if err != nil {
+		t.Fatalf("Get after update: %v", err)
+	}
+	if got.Value != second.Value {
+		t.Fatalf("got value %q, want %q (UPDATE path should have replaced the row, not added another)", got.Value, second.Value)
+	}
+
+	var rowCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM tokens WHERE token_key = ?", "client").Scan(&rowCount); err != nil {
+		t.Fatalf("count rows: %v", err)
+	}
+	if rowCount != 1 {
+		t.Fatalf("got %d rows for key %q, want 1", rowCount, "client")
+	}
+}
+
+func TestSQLTokenStore_PutHandlesConcurrentInsertRace(t *testing.T) {
+	db := openSQLiteTokenTable(t)
+	store := NewSQLTokenStore(db, "tokens")
+
+	tokenA := &AccessToken{Value: "a", ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Second)}
+	tokenB := &AccessToken{Value: "b", ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Second)}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs <- store.Put(context.Background(), "racer", tokenA, time.Hour)
+	}()
+	go func() {
+		defer wg.Done()
+		errs <- store.Put(context.Background(), "racer", tokenB, time.Hour)
+	}()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Put should resolve the INSERT conflict via its UPDATE retry, got error: %v", err)
+		}
+	}
+
+	var rowCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM tokens WHERE token_key = ?", "racer").Scan(&rowCount); err != nil {
+		t.Fatalf("count rows: %v", err)
+	}
+	if rowCount != 1 {
+		t.Fatalf("got %d rows for key %q after racing Puts, want exactly 1", rowCount, "racer")
+	}
+
+	got, err := store.Get(context.Background(), "racer")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Value != tokenA.Value && got.Value != tokenB.Value {
+		t.Fatalf("got value %q, want either %q or %q", got.Value, tokenA.Value, tokenB.Value)
+	}
+}